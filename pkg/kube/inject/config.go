@@ -0,0 +1,137 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inject
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// Config is a sidecar injection template and its accompanying values, for a
+// single revision.
+type Config struct {
+	Template string
+	Values   string
+}
+
+// defaultRevisionKey is the map key used for the unsuffixed config/values
+// pair, i.e. a single-revision injector, or the default revision found
+// alongside a set of revision-tagged ones.
+const defaultRevisionKey = ""
+
+var revisionConfigFileRe = regexp.MustCompile(`^config-(.+)$`)
+
+// loadConfigs loads injection Configs from configPath/valuesPath.
+//
+// If configPath names a regular file, a single Config is returned, keyed by
+// defaultRevisionKey.
+//
+// If configPath names a directory, it is scanned for config-<rev> files
+// (e.g. config-1.6, config-1.7), each paired with a values-<rev> file of the
+// same revision under valuesPath, plus an optional unsuffixed config/values
+// pair used as defaultRevisionKey. defaultRev, if set, must name one of the
+// discovered revisions; it is required whenever more than one is found and
+// there is no unsuffixed pair to fall back on.
+func loadConfigs(configPath, valuesPath, defaultRev string) (configs map[string]*Config, resolvedDefault string, err error) {
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !info.IsDir() {
+		config, err := loadConfig(configPath, valuesPath)
+		if err != nil {
+			return nil, "", err
+		}
+		return map[string]*Config{defaultRevisionKey: config}, defaultRevisionKey, nil
+	}
+
+	return loadConfigDir(configPath, valuesPath, defaultRev)
+}
+
+// loadConfig reads the injection template and values files named by
+// configPath and valuesPath.
+func loadConfig(configPath, valuesPath string) (*Config, error) {
+	template, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	values, err := ioutil.ReadFile(valuesPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{Template: string(template), Values: string(values)}, nil
+}
+
+func loadConfigDir(configPath, valuesPath, defaultRev string) (map[string]*Config, string, error) {
+	entries, err := ioutil.ReadDir(configPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	configs := map[string]*Config{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		m := revisionConfigFileRe.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		revision := m[1]
+		valuesFile := filepath.Join(valuesPath, "values-"+revision)
+		config, err := loadConfig(filepath.Join(configPath, e.Name()), valuesFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("loading revision %q: %v", revision, err)
+		}
+		configs[revision] = config
+	}
+
+	if config, err := loadConfig(filepath.Join(configPath, "config"), filepath.Join(valuesPath, "values")); err == nil {
+		configs[defaultRevisionKey] = config
+	}
+
+	if len(configs) == 0 {
+		return nil, "", fmt.Errorf("no injection configs found in %s", configPath)
+	}
+
+	resolvedDefault, err := resolveDefaultRevision(configs, defaultRev)
+	if err != nil {
+		return nil, "", err
+	}
+	return configs, resolvedDefault, nil
+}
+
+func resolveDefaultRevision(configs map[string]*Config, defaultRev string) (string, error) {
+	if defaultRev != "" {
+		if _, ok := configs[defaultRev]; !ok {
+			return "", fmt.Errorf("--defaultRevision %q not found among the discovered revisions", defaultRev)
+		}
+		return defaultRev, nil
+	}
+
+	if len(configs) == 1 {
+		for rev := range configs {
+			return rev, nil
+		}
+	}
+	if _, ok := configs[defaultRevisionKey]; ok {
+		return defaultRevisionKey, nil
+	}
+	return "", fmt.Errorf("multiple injection revisions found but --defaultRevision was not set")
+}
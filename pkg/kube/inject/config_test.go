@@ -0,0 +1,147 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inject
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, dir, name, contents string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inject-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile(t, dir, "config", "template: {}")
+	writeFile(t, dir, "values", "values: {}")
+
+	config, err := loadConfig(filepath.Join(dir, "config"), filepath.Join(dir, "values"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Template != "template: {}" {
+		t.Errorf("Template = %q, want %q", config.Template, "template: {}")
+	}
+	if config.Values != "values: {}" {
+		t.Errorf("Values = %q, want %q", config.Values, "values: {}")
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inject-config-missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := loadConfig(filepath.Join(dir, "config"), filepath.Join(dir, "values")); err == nil {
+		t.Fatal("expected an error for a missing config file")
+	}
+}
+
+func TestLoadConfigsSingleFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inject-configs-single")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile(t, dir, "config", "template: {}")
+	writeFile(t, dir, "values", "values: {}")
+
+	configs, defaultRev, err := loadConfigs(filepath.Join(dir, "config"), filepath.Join(dir, "values"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if defaultRev != defaultRevisionKey {
+		t.Errorf("defaultRev = %q, want %q", defaultRev, defaultRevisionKey)
+	}
+	if len(configs) != 1 {
+		t.Fatalf("len(configs) = %d, want 1", len(configs))
+	}
+}
+
+func TestLoadConfigsDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inject-configs-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile(t, dir, "config-1.6", "rev: 1.6")
+	writeFile(t, dir, "values-1.6", "v: 1.6")
+	writeFile(t, dir, "config-1.7", "rev: 1.7")
+	writeFile(t, dir, "values-1.7", "v: 1.7")
+
+	t.Run("requires defaultRevision with no unsuffixed default", func(t *testing.T) {
+		if _, _, err := loadConfigs(dir, dir, ""); err == nil {
+			t.Fatal("expected an error when --defaultRevision is unset and ambiguous")
+		}
+	})
+
+	t.Run("resolves the given defaultRevision", func(t *testing.T) {
+		configs, defaultRev, err := loadConfigs(dir, dir, "1.6")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if defaultRev != "1.6" {
+			t.Errorf("defaultRev = %q, want 1.6", defaultRev)
+		}
+		if len(configs) != 2 {
+			t.Fatalf("len(configs) = %d, want 2", len(configs))
+		}
+	})
+
+	t.Run("rejects an unknown defaultRevision", func(t *testing.T) {
+		if _, _, err := loadConfigs(dir, dir, "1.8"); err == nil {
+			t.Fatal("expected an error for an unknown --defaultRevision")
+		}
+	})
+}
+
+func TestLoadConfigsDirectoryWithDefault(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inject-configs-default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile(t, dir, "config-1.6", "rev: 1.6")
+	writeFile(t, dir, "values-1.6", "v: 1.6")
+	writeFile(t, dir, "config", "rev: default")
+	writeFile(t, dir, "values", "v: default")
+
+	configs, defaultRev, err := loadConfigs(dir, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if defaultRev != defaultRevisionKey {
+		t.Errorf("defaultRev = %q, want %q", defaultRev, defaultRevisionKey)
+	}
+	if len(configs) != 2 {
+		t.Fatalf("len(configs) = %d, want 2", len(configs))
+	}
+}
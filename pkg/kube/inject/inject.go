@@ -0,0 +1,103 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inject
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// sidecarTemplateData is made available to a Config's Template when
+// rendering the sidecar injection spec for a given pod.
+type sidecarTemplateData struct {
+	ObjectMeta *metav1.ObjectMeta
+	Spec       *corev1.PodSpec
+}
+
+// sidecarInjectionSpec is what a Config's Template must render, as YAML: the
+// init containers, containers and volumes to add to the pod.
+type sidecarInjectionSpec struct {
+	InitContainers []corev1.Container `json:"initContainers,omitempty"`
+	Containers     []corev1.Container `json:"containers,omitempty"`
+	Volumes        []corev1.Volume    `json:"volumes,omitempty"`
+}
+
+// renderSidecarInjectionSpec executes tmplText against meta/spec and parses
+// the result as a sidecarInjectionSpec.
+func renderSidecarInjectionSpec(tmplText string, meta *metav1.ObjectMeta, spec *corev1.PodSpec) (*sidecarInjectionSpec, error) {
+	tmpl, err := template.New("inject").Parse(tmplText)
+	if err != nil {
+		return nil, fmt.Errorf("parsing injection template: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, sidecarTemplateData{ObjectMeta: meta, Spec: spec}); err != nil {
+		return nil, fmt.Errorf("executing injection template: %v", err)
+	}
+
+	var out sidecarInjectionSpec
+	if err := yaml.Unmarshal(buf.Bytes(), &out); err != nil {
+		return nil, fmt.Errorf("parsing rendered injection spec: %v", err)
+	}
+	return &out, nil
+}
+
+// injectionPatch builds the JSON patch that adds spec's init containers,
+// containers and volumes to pod.
+func injectionPatch(pod *corev1.Pod, spec *sidecarInjectionSpec) ([]byte, error) {
+	var patch []map[string]interface{}
+	patch = append(patch, addContainers(pod.Spec.InitContainers, spec.InitContainers, "/spec/initContainers")...)
+	patch = append(patch, addContainers(pod.Spec.Containers, spec.Containers, "/spec/containers")...)
+	patch = append(patch, addVolumes(pod.Spec.Volumes, spec.Volumes, "/spec/volumes")...)
+	return json.Marshal(patch)
+}
+
+func addContainers(target, added []corev1.Container, basePath string) (patch []map[string]interface{}) {
+	first := len(target) == 0
+	for _, c := range added {
+		path := basePath
+		var value interface{} = c
+		if first {
+			first = false
+			value = []corev1.Container{c}
+		} else {
+			path += "/-"
+		}
+		patch = append(patch, map[string]interface{}{"op": "add", "path": path, "value": value})
+	}
+	return patch
+}
+
+func addVolumes(target, added []corev1.Volume, basePath string) (patch []map[string]interface{}) {
+	first := len(target) == 0
+	for _, v := range added {
+		path := basePath
+		var value interface{} = v
+		if first {
+			first = false
+			value = []corev1.Volume{v}
+		} else {
+			path += "/-"
+		}
+		patch = append(patch, map[string]interface{}{"op": "add", "path": path, "value": value})
+	}
+	return patch
+}
@@ -0,0 +1,309 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inject
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+)
+
+// RevisionLabel is the pod label used to select which injection template
+// revision a workload should be injected with. Pods without the label fall
+// back to the default revision resolved from WebhookParameters.DefaultRevision
+// (see loadConfigs).
+const RevisionLabel = "istio.io/rev"
+
+var (
+	runtimeScheme = runtime.NewScheme()
+	codecs        = serializer.NewCodecFactory(runtimeScheme)
+	deserializer  = codecs.UniversalDeserializer()
+)
+
+func init() {
+	_ = corev1.AddToScheme(runtimeScheme)
+	_ = admissionv1beta1.AddToScheme(runtimeScheme)
+}
+
+// WebhookParameters configures a Webhook.
+type WebhookParameters struct {
+	// ConfigFile names either a single injection template file, or a
+	// directory holding multiple revision-tagged template sets (see
+	// loadConfigs). ValuesFile is read the same way, in parallel.
+	ConfigFile string
+	ValuesFile string
+	// DefaultRevision selects the config used for pods that do not carry
+	// RevisionLabel. Required when ConfigFile holds more than one revision
+	// and none of them is the unsuffixed default.
+	DefaultRevision string
+
+	MeshFile string
+
+	CertFile string
+	KeyFile  string
+	// GetCertificate, if set, is used instead of CertFile/KeyFile so the
+	// HTTPS listener's certificate can be hot-reloaded (e.g. by a
+	// selfSignedCertController) without dropping connections or restarting
+	// the listener.
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	Port int
+
+	HealthCheckInterval time.Duration
+	HealthCheckFile     string
+
+	MonitoringPort int
+}
+
+// Webhook implements a mutating admission webhook for Istio sidecar
+// injection, serving one or more revision-tagged injection configs.
+type Webhook struct {
+	p WebhookParameters
+
+	mu              sync.RWMutex
+	configs         map[string]*Config
+	defaultRevision string
+
+	server *http.Server
+	// monitoringServer serves Prometheus metrics on WebhookParameters.MonitoringPort,
+	// separately from server since it is plain HTTP rather than TLS. Nil if
+	// MonitoringPort is 0.
+	monitoringServer *http.Server
+}
+
+// NewWebhook creates a Webhook from p, loading its injection config(s) and,
+// if ConfigFile names a directory, watching it for changes.
+func NewWebhook(p WebhookParameters) (*Webhook, error) {
+	configs, defaultRevision, err := loadConfigs(p.ConfigFile, p.ValuesFile, p.DefaultRevision)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load injection config: %v", err)
+	}
+
+	wh := &Webhook{
+		p:               p,
+		configs:         configs,
+		defaultRevision: defaultRevision,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/inject", wh.serveInject)
+
+	tlsConfig := &tls.Config{GetCertificate: p.GetCertificate}
+	if p.GetCertificate == nil {
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	wh.server = &http.Server{
+		Addr:      fmt.Sprintf(":%d", p.Port),
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+
+	if info, statErr := os.Stat(p.ConfigFile); statErr == nil && info.IsDir() {
+		if err := wh.watchConfigDir(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.MonitoringPort != 0 {
+		exporter, err := monitoring.RegisterPrometheusExporter(nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create monitoring exporter: %v", err)
+		}
+		monitoringMux := http.NewServeMux()
+		monitoringMux.Handle("/metrics", exporter)
+		wh.monitoringServer = &http.Server{
+			Addr:    fmt.Sprintf(":%d", p.MonitoringPort),
+			Handler: monitoringMux,
+		}
+	}
+
+	return wh, nil
+}
+
+// Run serves the webhook's HTTPS listener, and its Prometheus metrics
+// listener if WebhookParameters.MonitoringPort is set, until stopCh is
+// closed.
+func (wh *Webhook) Run(stopCh <-chan struct{}) {
+	go func() {
+		<-stopCh
+		_ = wh.server.Close()
+		if wh.monitoringServer != nil {
+			_ = wh.monitoringServer.Close()
+		}
+	}()
+
+	if wh.monitoringServer != nil {
+		go func() {
+			if err := wh.monitoringServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Errorf("sidecar injection webhook monitoring server failed: %v", err)
+			}
+		}()
+	}
+
+	if err := wh.server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+		log.Errorf("sidecar injection webhook server failed: %v", err)
+	}
+}
+
+// watchConfigDir reloads the injection configs whenever p.ConfigFile changes,
+// so that a multi-revision directory can be updated (e.g. a new control
+// plane revision rolled out) without restarting the injector.
+func (wh *Webhook) watchConfigDir() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(wh.p.ConfigFile); err != nil {
+		return fmt.Errorf("could not watch %v: %v", wh.p.ConfigFile, err)
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				wh.reloadConfigs()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("injection config watch error: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (wh *Webhook) reloadConfigs() {
+	configs, defaultRevision, err := loadConfigs(wh.p.ConfigFile, wh.p.ValuesFile, wh.p.DefaultRevision)
+	if err != nil {
+		log.Errorf("failed to reload injection configs from %s: %v", wh.p.ConfigFile, err)
+		return
+	}
+
+	wh.mu.Lock()
+	wh.configs, wh.defaultRevision = configs, defaultRevision
+	wh.mu.Unlock()
+	log.Infof("reloaded injection configs from %s", wh.p.ConfigFile)
+}
+
+func (wh *Webhook) configForRevision(revision string) (*Config, error) {
+	wh.mu.RLock()
+	defer wh.mu.RUnlock()
+
+	if revision == "" {
+		revision = wh.defaultRevision
+	}
+	config, ok := wh.configs[revision]
+	if !ok {
+		return nil, fmt.Errorf("no injection config for revision %q", revision)
+	}
+	return config, nil
+}
+
+// revisionFor returns the injection revision requested by podLabels, or ""
+// if it doesn't carry RevisionLabel. Namespace-level revision labels aren't
+// available here: the AdmissionRequest only carries the pod being injected,
+// not its namespace's labels.
+func revisionFor(podLabels map[string]string) string {
+	return podLabels[RevisionLabel]
+}
+
+func (wh *Webhook) serveInject(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	review := admissionv1beta1.AdmissionReview{}
+	if _, _, err := deserializer.Decode(body, nil, &review); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	review.Response = wh.inject(review.Request)
+	if review.Request != nil && review.Response != nil {
+		review.Response.UID = review.Request.UID
+	}
+
+	resp, err := json.Marshal(review)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(resp)
+}
+
+func (wh *Webhook) inject(req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	var pod corev1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		return toAdmissionError(err)
+	}
+
+	config, err := wh.configForRevision(revisionFor(pod.Labels))
+	if err != nil {
+		return toAdmissionError(err)
+	}
+
+	spec, err := renderSidecarInjectionSpec(config.Template, &pod.ObjectMeta, &pod.Spec)
+	if err != nil {
+		return toAdmissionError(err)
+	}
+
+	patchBytes, err := injectionPatch(&pod, spec)
+	if err != nil {
+		return toAdmissionError(err)
+	}
+
+	patchType := admissionv1beta1.PatchTypeJSONPatch
+	return &admissionv1beta1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patchBytes,
+		PatchType: &patchType,
+	}
+}
+
+func toAdmissionError(err error) *admissionv1beta1.AdmissionResponse {
+	return &admissionv1beta1.AdmissionResponse{
+		Allowed: false,
+		Result:  &metav1.Status{Message: err.Error()},
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inject
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestRevisionFor(t *testing.T) {
+	if r := revisionFor(map[string]string{RevisionLabel: "1.6"}); r != "1.6" {
+		t.Errorf("revisionFor() = %q, want %q", r, "1.6")
+	}
+	if r := revisionFor(map[string]string{"other": "label"}); r != "" {
+		t.Errorf("revisionFor() = %q, want %q", r, "")
+	}
+	if r := revisionFor(nil); r != "" {
+		t.Errorf("revisionFor(nil) = %q, want %q", r, "")
+	}
+}
+
+func newTestWebhook(configs map[string]*Config, defaultRevision string) *Webhook {
+	return &Webhook{configs: configs, defaultRevision: defaultRevision}
+}
+
+func TestConfigForRevision(t *testing.T) {
+	configs := map[string]*Config{
+		"1.6":              {Template: "rev: 1.6"},
+		defaultRevisionKey: {Template: "rev: default"},
+	}
+	wh := newTestWebhook(configs, defaultRevisionKey)
+
+	config, err := wh.configForRevision("1.6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Template != "rev: 1.6" {
+		t.Errorf("Template = %q, want %q", config.Template, "rev: 1.6")
+	}
+
+	config, err = wh.configForRevision("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Template != "rev: default" {
+		t.Errorf("Template = %q, want %q", config.Template, "rev: default")
+	}
+
+	if _, err := wh.configForRevision("1.8"); err == nil {
+		t.Fatal("expected an error for an unknown revision")
+	}
+}
+
+func podAdmissionRequest(t *testing.T, labels map[string]string) *admissionv1beta1.AdmissionRequest {
+	t.Helper()
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Labels: labels},
+	}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &admissionv1beta1.AdmissionRequest{Object: runtime.RawExtension{Raw: raw}}
+}
+
+func TestInjectSelectsConfigPerRevision(t *testing.T) {
+	configs := map[string]*Config{
+		"1.6":              {Template: "containers:\n- name: istio-proxy-1.6\n  image: proxy:1.6\n"},
+		defaultRevisionKey: {Template: "containers:\n- name: istio-proxy-default\n  image: proxy:default\n"},
+	}
+	wh := newTestWebhook(configs, defaultRevisionKey)
+
+	cases := []struct {
+		name      string
+		labels    map[string]string
+		wantImage string
+	}{
+		{name: "revision label selects that revision's template", labels: map[string]string{RevisionLabel: "1.6"}, wantImage: "proxy:1.6"},
+		{name: "no revision label falls back to the default", labels: nil, wantImage: "proxy:default"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := podAdmissionRequest(t, c.labels)
+			resp := wh.inject(req)
+			if !resp.Allowed {
+				t.Fatalf("inject() not allowed: %v", resp.Result)
+			}
+			if !strings.Contains(string(resp.Patch), c.wantImage) {
+				t.Errorf("patch = %s, want it to contain %q", resp.Patch, c.wantImage)
+			}
+		})
+	}
+}
+
+func TestInjectUnknownRevisionIsDenied(t *testing.T) {
+	wh := newTestWebhook(map[string]*Config{defaultRevisionKey: {Template: "containers: []"}}, defaultRevisionKey)
+
+	req := podAdmissionRequest(t, map[string]string{RevisionLabel: "unknown"})
+	resp := wh.inject(req)
+	if resp.Allowed {
+		t.Fatal("expected inject() to deny a pod requesting an unconfigured revision")
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientadmissionregistrationv1beta1 "k8s.io/client-go/kubernetes/typed/admissionregistration/v1beta1"
+)
+
+// PatchMutatingWebhookConfig sets the CABundle of the webhook entry named
+// webhookName, in the MutatingWebhookConfiguration named webhookConfigName,
+// to caCertPem. It is a no-op if the CABundle is already up to date.
+func PatchMutatingWebhookConfig(client clientadmissionregistrationv1beta1.MutatingWebhookConfigurationInterface,
+	webhookConfigName, webhookName string, caCertPem []byte) error {
+	config, err := client.Get(webhookConfigName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	found := false
+	changed := false
+	for i := range config.Webhooks {
+		if config.Webhooks[i].Name != webhookName {
+			continue
+		}
+		found = true
+		if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, caCertPem) {
+			config.Webhooks[i].ClientConfig.CABundle = caCertPem
+			changed = true
+		}
+		break
+	}
+	if !found {
+		return fmt.Errorf("webhook entry %q not found in MutatingWebhookConfiguration %q", webhookName, webhookConfigName)
+	}
+	if !changed {
+		return nil
+	}
+
+	_, err = client.Update(config)
+	return err
+}
+
+// PatchValidatingWebhookConfig sets the CABundle of the webhook entry named
+// webhookName, in the ValidatingWebhookConfiguration named webhookConfigName,
+// to caCertPem. It is a no-op if the CABundle is already up to date.
+func PatchValidatingWebhookConfig(client clientadmissionregistrationv1beta1.ValidatingWebhookConfigurationInterface,
+	webhookConfigName, webhookName string, caCertPem []byte) error {
+	config, err := client.Get(webhookConfigName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	found := false
+	changed := false
+	for i := range config.Webhooks {
+		if config.Webhooks[i].Name != webhookName {
+			continue
+		}
+		found = true
+		if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, caCertPem) {
+			config.Webhooks[i].ClientConfig.CABundle = caCertPem
+			changed = true
+		}
+		break
+	}
+	if !found {
+		return fmt.Errorf("webhook entry %q not found in ValidatingWebhookConfiguration %q", webhookName, webhookConfigName)
+	}
+	if !changed {
+		return nil
+	}
+
+	_, err = client.Update(config)
+	return err
+}
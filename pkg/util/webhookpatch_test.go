@@ -0,0 +1,104 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bytes"
+	"testing"
+
+	"k8s.io/api/admissionregistration/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPatchMutatingWebhookConfig(t *testing.T) {
+	const configName = "istio-sidecar-injector"
+	const webhookName = "sidecar-injector.istio.io"
+
+	cases := []struct {
+		name    string
+		initial []byte
+		patch   []byte
+		wantErr bool
+	}{
+		{name: "patches a stale CABundle", initial: []byte("old"), patch: []byte("new")},
+		{name: "no-op when already up to date", initial: []byte("same"), patch: []byte("same")},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(&v1beta1.MutatingWebhookConfiguration{
+				ObjectMeta: metav1.ObjectMeta{Name: configName},
+				Webhooks: []v1beta1.Webhook{
+					{Name: webhookName, ClientConfig: v1beta1.WebhookClientConfig{CABundle: c.initial}},
+				},
+			})
+
+			err := PatchMutatingWebhookConfig(client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations(),
+				configName, webhookName, c.patch)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got err %v, wantErr %v", err, c.wantErr)
+			}
+
+			got, err := client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Get(configName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Webhooks[0].ClientConfig.CABundle, c.patch) {
+				t.Errorf("CABundle = %q, want %q", got.Webhooks[0].ClientConfig.CABundle, c.patch)
+			}
+		})
+	}
+}
+
+func TestPatchMutatingWebhookConfigMissingWebhook(t *testing.T) {
+	const configName = "istio-sidecar-injector"
+
+	client := fake.NewSimpleClientset(&v1beta1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: configName},
+		Webhooks:   []v1beta1.Webhook{{Name: "other.istio.io"}},
+	})
+
+	err := PatchMutatingWebhookConfig(client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations(),
+		configName, "sidecar-injector.istio.io", []byte("ca"))
+	if err == nil {
+		t.Fatal("expected an error for a missing webhook entry, got nil")
+	}
+}
+
+func TestPatchValidatingWebhookConfig(t *testing.T) {
+	const configName = "istio-galley"
+	const webhookName = "validation.istio.io"
+
+	client := fake.NewSimpleClientset(&v1beta1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: configName},
+		Webhooks: []v1beta1.Webhook{
+			{Name: webhookName, ClientConfig: v1beta1.WebhookClientConfig{CABundle: []byte("old")}},
+		},
+	})
+
+	if err := PatchValidatingWebhookConfig(client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations(),
+		configName, webhookName, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Get(configName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Webhooks[0].ClientConfig.CABundle, []byte("new")) {
+		t.Errorf("CABundle = %q, want %q", got.Webhooks[0].ClientConfig.CABundle, "new")
+	}
+}
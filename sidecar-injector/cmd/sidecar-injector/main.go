@@ -15,28 +15,20 @@
 package main
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
-	"github.com/howeyc/fsnotify"
 	"github.com/spf13/cobra"
 	"github.com/spf13/cobra/doc"
-	"k8s.io/api/admissionregistration/v1beta1"
-	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
-	"k8s.io/client-go/tools/cache"
 
 	"istio.io/istio/pkg/cmd"
 	"istio.io/istio/pkg/kube"
 	"istio.io/istio/pkg/kube/inject"
-	"istio.io/istio/pkg/util"
 	"istio.io/pkg/collateral"
 	"istio.io/pkg/log"
 	"istio.io/pkg/probe"
@@ -47,21 +39,28 @@ var (
 	flags = struct {
 		loggingOptions *log.Options
 
-		meshconfig             string
-		injectConfigFile       string
-		injectValuesFile       string
-		certFile               string
-		privateKeyFile         string
-		caCertFile             string
-		port                   int
-		healthCheckInterval    time.Duration
-		healthCheckFile        string
-		probeOptions           probe.Options
-		kubeconfigFile         string
-		webhookConfigName      string
-		webhookName            string
-		monitoringPort         int
-		reconcileWebhookConfig bool
+		meshconfig                  string
+		injectConfigFile            string
+		injectValuesFile            string
+		certFile                    string
+		privateKeyFile              string
+		caCertFile                  string
+		port                        int
+		healthCheckInterval         time.Duration
+		healthCheckFile             string
+		probeOptions                probe.Options
+		kubeconfigFile              string
+		webhookConfigName           string
+		validatingWebhookConfigName string
+		webhookName                 string
+		monitoringPort              int
+		reconcileWebhookConfig      bool
+		selfSignedCerts             bool
+		selfSignedCertTTL           time.Duration
+		selfSignedCertSecret        string
+		selfSignedCertDNSNames      []string
+		namespace                   string
+		defaultRevision             string
 	}{
 		loggingOptions: log.DefaultOptions(),
 	}
@@ -82,6 +81,7 @@ var (
 			parameters := inject.WebhookParameters{
 				ConfigFile:          flags.injectConfigFile,
 				ValuesFile:          flags.injectValuesFile,
+				DefaultRevision:     flags.defaultRevision,
 				MeshFile:            flags.meshconfig,
 				CertFile:            flags.certFile,
 				KeyFile:             flags.privateKeyFile,
@@ -90,14 +90,32 @@ var (
 				HealthCheckFile:     flags.healthCheckFile,
 				MonitoringPort:      flags.monitoringPort,
 			}
+
+			stop := make(chan struct{})
+
+			var selfSignedCtl *selfSignedCertController
+			if flags.selfSignedCerts {
+				client, err := kube.CreateClientset(flags.kubeconfigFile, "")
+				if err != nil {
+					return multierror.Prefix(err, "failed to create kube client for self-signed certs")
+				}
+				selfSignedCtl = newSelfSignedCertController(client, flags.namespace, flags.selfSignedCertSecret,
+					flags.selfSignedCertDNSNames, flags.selfSignedCertTTL, nil)
+				if err := selfSignedCtl.Run(stop); err != nil {
+					return multierror.Prefix(err, "failed to start self-signed cert controller")
+				}
+				parameters.CertFile = ""
+				parameters.KeyFile = ""
+				parameters.GetCertificate = selfSignedCtl.GetCertificate
+			}
+
 			wh, err := inject.NewWebhook(parameters)
 			if err != nil {
 				return multierror.Prefix(err, "failed to create injection webhook")
 			}
 
-			stop := make(chan struct{})
 			if flags.reconcileWebhookConfig {
-				if err := patchCertLoop(stop); err != nil {
+				if err := patchCertLoop(stop, selfSignedCtl); err != nil {
 					return multierror.Prefix(err, "failed to start patch cert loop")
 				}
 			}
@@ -125,127 +143,40 @@ var (
 	}
 )
 
-const delayedRetryTime = time.Second
-
-func patchCertLoop(stopCh <-chan struct{}) error {
+func patchCertLoop(stopCh <-chan struct{}, selfSignedCtl *selfSignedCertController) error {
 	client, err := kube.CreateClientset(flags.kubeconfigFile, "")
 	if err != nil {
 		return err
 	}
 
-	caCertPem, err := ioutil.ReadFile(flags.caCertFile)
-	if err != nil {
-		return err
-	}
-
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return err
-	}
-	watchDir, _ := filepath.Split(flags.caCertFile)
-	if err = watcher.Watch(watchDir); err != nil {
-		return fmt.Errorf("could not watch %v: %v", flags.caCertFile, err)
-	}
-
-	var retry bool
-	if err = util.PatchMutatingWebhookConfig(client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations(),
-		flags.webhookConfigName, flags.webhookName, caCertPem); err != nil {
-		retry = true
+	var reconciler *webhookReconciler
+	if selfSignedCtl != nil {
+		reconciler = newWebhookReconciler(client, flags.webhookConfigName, flags.validatingWebhookConfigName,
+			flags.webhookName, "", func() ([]byte, error) { return selfSignedCtl.CACertPem(), nil })
+		// The CA bundle is owned by selfSignedCtl, which also drives
+		// re-patching whenever it replaces the CA. Leaf-only rotations keep
+		// the same CA, so they do not trigger a re-patch.
+		selfSignedCtl.onCAChanged = func([]byte) { reconciler.Sync() }
+	} else {
+		reconciler = newWebhookReconciler(client, flags.webhookConfigName, flags.validatingWebhookConfigName,
+			flags.webhookName, flags.caCertFile, func() ([]byte, error) { return ioutil.ReadFile(flags.caCertFile) })
 	}
 
-	shouldPatch := make(chan struct{})
-
-	watchlist := cache.NewListWatchFromClient(
-		client.AdmissionregistrationV1beta1().RESTClient(),
-		"mutatingwebhookconfigurations",
-		"",
-		fields.ParseSelectorOrDie(fmt.Sprintf("metadata.name=%s", flags.webhookConfigName)))
-
-	_, controller := cache.NewInformer(
-		watchlist,
-		&v1beta1.MutatingWebhookConfiguration{},
-		0,
-		cache.ResourceEventHandlerFuncs{
-			UpdateFunc: func(oldObj, newObj interface{}) {
-				oldConfig := oldObj.(*v1beta1.MutatingWebhookConfiguration)
-				newConfig := newObj.(*v1beta1.MutatingWebhookConfiguration)
-
-				if oldConfig.ResourceVersion != newConfig.ResourceVersion {
-					for i, w := range newConfig.Webhooks {
-						if w.Name == flags.webhookName && !bytes.Equal(newConfig.Webhooks[i].ClientConfig.CABundle, caCertPem) {
-							log.Infof("Detected a change in CABundle, patching MutatingWebhookConfiguration again")
-							shouldPatch <- struct{}{}
-							break
-						}
-					}
-				}
-			},
-		},
-	)
-	go controller.Run(stopCh)
-
-	go func() {
-		var delayedRetryC <-chan time.Time
-		if retry {
-			delayedRetryC = time.After(delayedRetryTime)
-		}
-
-		for {
-			select {
-			case <-delayedRetryC:
-				if retry := doPatch(client, caCertPem); retry {
-					delayedRetryC = time.After(delayedRetryTime)
-				} else {
-					log.Infof("Retried patch succeeded")
-					delayedRetryC = nil
-				}
-			case <-shouldPatch:
-				if retry := doPatch(client, caCertPem); retry {
-					if delayedRetryC == nil {
-						delayedRetryC = time.After(delayedRetryTime)
-					}
-				} else {
-					delayedRetryC = nil
-				}
-			case <-watcher.Event:
-				if b, err := ioutil.ReadFile(flags.caCertFile); err == nil {
-					log.Infof("Detected a change in CABundle (via secret), patching MutatingWebhookConfiguration again")
-					caCertPem = b
-
-					if retry := doPatch(client, caCertPem); retry {
-						if delayedRetryC == nil {
-							delayedRetryC = time.After(delayedRetryTime)
-							log.Infof("Patch failed - retrying every %v until success", delayedRetryTime)
-						}
-					} else {
-						delayedRetryC = nil
-					}
-				} else {
-					log.Errorf("CA bundle file read error: %v", err)
-				}
-			}
-		}
-	}()
-
-	return nil
-}
-
-func doPatch(cs *kubernetes.Clientset, caCertPem []byte) (retry bool) {
-	client := cs.AdmissionregistrationV1beta1().MutatingWebhookConfigurations()
-	if err := util.PatchMutatingWebhookConfig(client, flags.webhookConfigName, flags.webhookName, caCertPem); err != nil {
-		log.Errorf("Patch webhook failed: %v", err)
-		return true
-	}
-	return false
+	return reconciler.Run(stopCh)
 }
 
 func init() {
 	rootCmd.PersistentFlags().StringVar(&flags.meshconfig, "meshConfig", "/etc/istio/config/mesh",
 		"File containing the Istio mesh configuration")
 	rootCmd.PersistentFlags().StringVar(&flags.injectConfigFile, "injectConfig", "/etc/istio/inject/config",
-		"File containing the Istio sidecar injection configuration and template")
+		"File containing the Istio sidecar injection configuration and template. If a directory is given instead, "+
+			"it is scanned for multiple revision-tagged template sets (e.g. config-1.6, config-1.7), one per revision.")
 	rootCmd.PersistentFlags().StringVar(&flags.injectValuesFile, "injectValues", "/etc/istio/inject/values",
-		"File containing the Istio sidecar injection values, in yaml format")
+		"File containing the Istio sidecar injection values, in yaml format. If --injectConfig is a directory, "+
+			"this is treated the same way, with one revision-tagged values file per template set.")
+	rootCmd.PersistentFlags().StringVar(&flags.defaultRevision, "defaultRevision", "",
+		"Revision to use for pods that do not carry the istio.io/rev label, when --injectConfig holds multiple "+
+			"revisions. Required in that mode unless the directory also holds an unsuffixed config/values pair.")
 	rootCmd.PersistentFlags().StringVar(&flags.certFile, "tlsCertFile", "/etc/istio/certs/cert-chain.pem",
 		"File containing the x509 Certificate for HTTPS.")
 	rootCmd.PersistentFlags().StringVar(&flags.privateKeyFile, "tlsKeyFile", "/etc/istio/certs/key.pem",
@@ -265,8 +196,24 @@ func init() {
 		"Name of the mutatingwebhookconfiguration resource in Kubernetes.")
 	rootCmd.PersistentFlags().StringVar(&flags.webhookName, "webhookName", "sidecar-injector.istio.io",
 		"Name of the webhook entry in the webhook config.")
+	rootCmd.PersistentFlags().StringVar(&flags.validatingWebhookConfigName, "validatingWebhookConfigName", "",
+		"Name of the validatingwebhookconfiguration resource in Kubernetes. If set, its CABundle is kept in "+
+			"sync with the mutating webhook's, alongside the injection webhook.")
 	rootCmd.PersistentFlags().BoolVar(&flags.reconcileWebhookConfig, "reconcileWebhookConfig", true,
 		"Enable managing webhook configuration.")
+	rootCmd.PersistentFlags().BoolVar(&flags.selfSignedCerts, "selfSignedCerts", false,
+		"Generate and rotate a self-signed CA and server certificate for the webhook instead of requiring "+
+			"--tlsCertFile, --tlsKeyFile and --caCertFile to be pre-provisioned.")
+	rootCmd.PersistentFlags().DurationVar(&flags.selfSignedCertTTL, "selfSignedCertTTL", selfSignedCertTTL,
+		"Lifetime of the self-signed server certificate generated when --selfSignedCerts is set; the CA is valid "+
+			"for four times as long. The certificate is rotated at roughly two thirds of this duration.")
+	rootCmd.PersistentFlags().StringVar(&flags.selfSignedCertSecret, "selfSignedCertSecret", "istio-sidecar-injector-certs",
+		"Name of the Secret used to persist the self-signed CA and server certificate when --selfSignedCerts is set.")
+	rootCmd.PersistentFlags().StringSliceVar(&flags.selfSignedCertDNSNames, "selfSignedCertDNSNames",
+		[]string{"istio-sidecar-injector.istio-system.svc"},
+		"DNS names the self-signed server certificate should be valid for when --selfSignedCerts is set.")
+	rootCmd.PersistentFlags().StringVar(&flags.namespace, "namespace", "istio-system",
+		"Namespace in which the injector and its Secrets live.")
 	// Attach the Istio logging options to the command.
 	flags.loggingOptions.AttachCobraFlags(rootCmd)
 
@@ -0,0 +1,480 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"istio.io/pkg/log"
+)
+
+// selfSignedCertTTL is the lifetime of the self-signed leaf certificate when
+// --selfSignedCerts is enabled. The CA is minted with
+// selfSignedCACertTTLMultiplier times this lifetime.
+const selfSignedCertTTL = 90 * 24 * time.Hour
+
+// selfSignedCertRotationGracePeriod controls how much of the certificate's
+// lifetime elapses before it is rotated. A leaf minted with a 90 day TTL is
+// therefore refreshed after roughly 60 days, well before clients relying on
+// the old CABundle would see expiry failures.
+const selfSignedCertRotationGracePeriod = 2.0 / 3.0
+
+const selfSignedCertRSAKeySize = 2048
+
+// selfSignedCACertTTLMultiplier makes the CA materially longer-lived than
+// the leaf certificate it signs. Without this gap, "is the CA close to
+// expiring" would trip on literally the first scheduled leaf rotation (a CA
+// and leaf minted together with the same TTL both have the same remaining
+// lifetime at that point), defeating the whole point of rotate() reusing
+// the existing CA.
+const selfSignedCACertTTLMultiplier = 4
+
+// selfSignedCertController generates and maintains a self-signed CA and
+// server certificate for the injection webhook, persisting them to a
+// Kubernetes Secret and rotating the leaf certificate before it expires.
+// It removes the need for Citadel (or another external CA) to provision
+// --tlsCertFile, --tlsKeyFile and --caCertFile up front.
+type selfSignedCertController struct {
+	client      kubernetes.Interface
+	namespace   string
+	secretName  string
+	dnsNames    []string
+	certTTL     time.Duration
+	onCAChanged func(caCertPem []byte)
+
+	cert atomic.Value // stores *tls.Certificate
+
+	mu        sync.Mutex
+	caKey     *rsa.PrivateKey
+	caCert    *x509.Certificate
+	caCertPem []byte
+	caKeyPem  []byte
+	leafCert  *x509.Certificate
+}
+
+// newSelfSignedCertController creates a controller that will generate (or
+// load, if already present in the Secret) a self-signed CA and leaf
+// certificate for dnsNames. onCAChanged, if non-nil, is invoked with the PEM
+// encoded CA certificate whenever the CA is (re)generated, so that callers
+// such as patchCertLoop can re-patch the MutatingWebhookConfiguration.
+func newSelfSignedCertController(client kubernetes.Interface, namespace, secretName string, dnsNames []string,
+	certTTL time.Duration, onCAChanged func(caCertPem []byte)) *selfSignedCertController {
+	return &selfSignedCertController{
+		client:      client,
+		namespace:   namespace,
+		secretName:  secretName,
+		dnsNames:    dnsNames,
+		certTTL:     certTTL,
+		onCAChanged: onCAChanged,
+	}
+}
+
+// Run loads an existing CA/cert pair from the Secret if present, otherwise
+// generates a new self-signed CA and leaf certificate, and then rotates the
+// leaf on a timer until stopCh is closed.
+func (c *selfSignedCertController) Run(stopCh <-chan struct{}) error {
+	if err := c.loadOrGenerate(); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			wait := c.nextRotation()
+			select {
+			case <-time.After(wait):
+				if err := c.rotate(); err != nil {
+					log.Errorf("self-signed cert rotation failed, will retry: %v", err)
+					continue
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// CACertPem returns the PEM encoded CA certificate currently in use.
+func (c *selfSignedCertController) CACertPem() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.caCertPem
+}
+
+// GetCertificate implements the tls.Config.GetCertificate callback, allowing
+// the HTTPS listener used by inject.Webhook to pick up rotated certificates
+// without dropping existing connections or restarting the listener.
+func (c *selfSignedCertController) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, ok := c.cert.Load().(*tls.Certificate)
+	if !ok || cert == nil {
+		return nil, fmt.Errorf("self-signed certificate not yet generated")
+	}
+	return cert, nil
+}
+
+func (c *selfSignedCertController) loadOrGenerate() error {
+	secret, err := c.client.CoreV1().Secrets(c.namespace).Get(c.secretName, metav1.GetOptions{})
+	if err == nil {
+		caKey, caCert, leafPem, leafKeyPem, caPem, caKeyPem, loadErr := parseSecret(secret)
+		if loadErr == nil {
+			c.mu.Lock()
+			c.caKey, c.caCert, c.caCertPem, c.caKeyPem = caKey, caCert, caPem, caKeyPem
+			c.mu.Unlock()
+			return c.setLeaf(leafPem, leafKeyPem)
+		}
+		log.Warnf("existing %s/%s secret could not be parsed, regenerating: %v", c.namespace, c.secretName, loadErr)
+	} else if !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	return c.bootstrapCA()
+}
+
+// nextRotation schedules rotation off of the leaf certificate's own expiry,
+// not the CA's: the CA is long-lived and only rotated when it is itself
+// close to expiring, while the leaf is refreshed routinely off the same CA.
+func (c *selfSignedCertController) nextRotation() time.Duration {
+	c.mu.Lock()
+	leafCert := c.leafCert
+	c.mu.Unlock()
+	if leafCert == nil {
+		return 0
+	}
+	lifetime := time.Until(leafCert.NotAfter)
+	rotateIn := time.Duration(float64(c.certTTL) * selfSignedCertRotationGracePeriod)
+	wait := lifetime - (c.certTTL - rotateIn)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// rotate refreshes the leaf certificate served by GetCertificate. Routine
+// rotations reuse the existing CA and only mint a new leaf, signed by that
+// same CA: regenerating the CA on every rotation would change the
+// CABundle that the webhook reconciler patches into the
+// MutatingWebhookConfiguration, and the async, rate-limited reconciler can
+// lag behind a hot-swapped certificate long enough for API server
+// connections to be dropped with "x509: certificate signed by unknown
+// authority". A brand new CA is only minted here if the existing one is
+// itself close to expiring.
+func (c *selfSignedCertController) rotate() error {
+	c.mu.Lock()
+	caCert := c.caCert
+	c.mu.Unlock()
+
+	if caCert == nil || time.Until(caCert.NotAfter) < c.certTTL {
+		log.Infof("self-signed CA is approaching expiry, rotating CA and leaf certificate")
+		return c.bootstrapCA()
+	}
+
+	log.Infof("rotating self-signed injection webhook leaf certificate")
+	return c.rotateLeaf()
+}
+
+// bootstrapCA mints a fresh CA and leaf certificate and persists them to the
+// Secret via createOrAdoptCA, then hot-swaps the tls.Certificate served by
+// GetCertificate. It is used on first startup (no valid secret found) and,
+// rarely, when the current CA is itself close to expiring.
+//
+// Bootstrap is the one case where two replicas can race to create the same
+// Secret (there is nothing to Update yet): if that happens here, the
+// replica that lost the race adopts the winner's CA and leaf instead of
+// persisting its own, so that all replicas converge on a single CA.
+func (c *selfSignedCertController) bootstrapCA() error {
+	caKey, caCert, caCertPem, caKeyPem, err := generateSelfSignedCA(c.certTTL * selfSignedCACertTTLMultiplier)
+	if err != nil {
+		return fmt.Errorf("failed to generate self-signed CA: %v", err)
+	}
+
+	leafCertPem, leafKeyPem, err := generateLeafCert(caKey, caCert, c.dnsNames, c.certTTL)
+	if err != nil {
+		return fmt.Errorf("failed to generate leaf certificate: %v", err)
+	}
+
+	caKey, caCert, caCertPem, caKeyPem, leafCertPem, leafKeyPem, err =
+		c.createOrAdoptCA(caKey, caCert, caCertPem, caKeyPem, leafCertPem, leafKeyPem)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.caKey, c.caCert, c.caCertPem, c.caKeyPem = caKey, caCert, caCertPem, caKeyPem
+	c.mu.Unlock()
+
+	if err := c.setLeaf(leafCertPem, leafKeyPem); err != nil {
+		return err
+	}
+
+	if c.onCAChanged != nil {
+		c.onCAChanged(caCertPem)
+	}
+	return nil
+}
+
+// createOrAdoptCA creates the Secret holding caCertPem/caKeyPem/leafCertPem/
+// leafKeyPem. If another replica's bootstrapCA created it first, its CA and
+// leaf are loaded and returned instead of the ones passed in, mirroring
+// loadOrGenerate's existing-secret path. An existing Secret that cannot be
+// parsed, or that still holds this controller's current CA, is overwritten
+// with the ones passed in instead.
+func (c *selfSignedCertController) createOrAdoptCA(caKey *rsa.PrivateKey, caCert *x509.Certificate, caCertPem, caKeyPem, leafCertPem, leafKeyPem []byte) (
+	*rsa.PrivateKey, *x509.Certificate, []byte, []byte, []byte, []byte, error) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      c.secretName,
+			Namespace: c.namespace,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			"ca-cert.pem":    caCertPem,
+			"ca-key.pem":     caKeyPem,
+			"cert-chain.pem": leafCertPem,
+			"key.pem":        leafKeyPem,
+		},
+	}
+
+	_, err := c.client.CoreV1().Secrets(c.namespace).Create(secret)
+	if err == nil {
+		return caKey, caCert, caCertPem, caKeyPem, leafCertPem, leafKeyPem, nil
+	}
+	if !k8serrors.IsAlreadyExists(err) {
+		return nil, nil, nil, nil, nil, nil, fmt.Errorf("failed to persist certificates to secret %s/%s: %v", c.namespace, c.secretName, err)
+	}
+
+	log.Infof("%s/%s secret already exists, adopting its CA unless it is unreadable or holds the CA being replaced", c.namespace, c.secretName)
+	existing, err := c.client.CoreV1().Secrets(c.namespace).Get(c.secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, fmt.Errorf("failed to load %s/%s secret created by another replica: %v", c.namespace, c.secretName, err)
+	}
+	adoptedKey, adoptedCert, adoptedLeafPem, adoptedLeafKeyPem, adoptedCACertPem, adoptedCAKeyPem, err := parseSecret(existing)
+	c.mu.Lock()
+	currentCACert := c.caCert
+	c.mu.Unlock()
+	if err != nil || (currentCACert != nil && adoptedCert.Equal(currentCACert)) {
+		existing.Data = secret.Data
+		if _, err := c.client.CoreV1().Secrets(c.namespace).Update(existing); err != nil {
+			return nil, nil, nil, nil, nil, nil, fmt.Errorf("failed to persist certificates to secret %s/%s: %v", c.namespace, c.secretName, err)
+		}
+		return caKey, caCert, caCertPem, caKeyPem, leafCertPem, leafKeyPem, nil
+	}
+	return adoptedKey, adoptedCert, adoptedCACertPem, adoptedCAKeyPem, adoptedLeafPem, adoptedLeafKeyPem, nil
+}
+
+// rotateLeaf signs a fresh leaf certificate with the existing CA and
+// persists it to the Secret, leaving ca-cert.pem/ca-key.pem untouched. Since
+// the CABundle trusted by the webhook configurations is unchanged, callers
+// do not need to re-patch them, so onCAChanged is not invoked.
+func (c *selfSignedCertController) rotateLeaf() error {
+	c.mu.Lock()
+	caKey, caCert, caCertPem, caKeyPem := c.caKey, c.caCert, c.caCertPem, c.caKeyPem
+	c.mu.Unlock()
+
+	leafCertPem, leafKeyPem, err := generateLeafCert(caKey, caCert, c.dnsNames, c.certTTL)
+	if err != nil {
+		return fmt.Errorf("failed to generate leaf certificate: %v", err)
+	}
+
+	if err := c.writeSecret(caCertPem, caKeyPem, leafCertPem, leafKeyPem); err != nil {
+		return fmt.Errorf("failed to persist certificates to secret %s/%s: %v", c.namespace, c.secretName, err)
+	}
+
+	return c.setLeaf(leafCertPem, leafKeyPem)
+}
+
+func (c *selfSignedCertController) setLeaf(certPem, keyPem []byte) error {
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return fmt.Errorf("failed to load generated key pair: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse generated leaf certificate: %v", err)
+	}
+
+	c.mu.Lock()
+	c.leafCert = leaf
+	c.mu.Unlock()
+
+	c.cert.Store(&cert)
+	return nil
+}
+
+// writeSecret creates the Secret if it does not exist, or overwrites its data
+// in place otherwise. Unlike createOrAdoptCA, it never adopts a CA that
+// another replica has written to the Secret.
+func (c *selfSignedCertController) writeSecret(caCertPem, caKeyPem, certPem, keyPem []byte) error {
+	data := map[string][]byte{
+		"ca-cert.pem":    caCertPem,
+		"ca-key.pem":     caKeyPem,
+		"cert-chain.pem": certPem,
+		"key.pem":        keyPem,
+	}
+
+	secrets := c.client.CoreV1().Secrets(c.namespace)
+	existing, err := secrets.Get(c.secretName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      c.secretName,
+				Namespace: c.namespace,
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: data,
+		}
+		_, err = secrets.Create(secret)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	existing.Data = data
+	_, err = secrets.Update(existing)
+	return err
+}
+
+func parseSecret(secret *corev1.Secret) (caKey *rsa.PrivateKey, caCert *x509.Certificate, certPem, keyPem, caCertPem, caKeyPem []byte, err error) {
+	caCertPem, ok := secret.Data["ca-cert.pem"]
+	if !ok {
+		return nil, nil, nil, nil, nil, nil, fmt.Errorf("missing ca-cert.pem")
+	}
+	caKeyPem, ok = secret.Data["ca-key.pem"]
+	if !ok {
+		return nil, nil, nil, nil, nil, nil, fmt.Errorf("missing ca-key.pem")
+	}
+	certPem, ok = secret.Data["cert-chain.pem"]
+	if !ok {
+		return nil, nil, nil, nil, nil, nil, fmt.Errorf("missing cert-chain.pem")
+	}
+	keyPem, ok = secret.Data["key.pem"]
+	if !ok {
+		return nil, nil, nil, nil, nil, nil, fmt.Errorf("missing key.pem")
+	}
+
+	caKey, caCert, err = parseCAKeyPair(caCertPem, caKeyPem)
+	return caKey, caCert, certPem, keyPem, caCertPem, caKeyPem, err
+}
+
+// generateSelfSignedCA mints a new CA certificate and private key valid for ttl.
+func generateSelfSignedCA(ttl time.Duration) (key *rsa.PrivateKey, cert *x509.Certificate, certPem, keyPem []byte, err error) {
+	key, err = rsa.GenerateKey(rand.Reader, selfSignedCertRSAKeySize)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "istio-sidecar-injector-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(ttl),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	return key, cert, encodeCertPEM(der), encodeKeyPEM(key), nil
+}
+
+func parseCAKeyPair(certPem, keyPem []byte) (*rsa.PrivateKey, *x509.Certificate, error) {
+	tlsCert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := tlsCert.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("CA private key is not RSA")
+	}
+	return key, cert, nil
+}
+
+// generateLeafCert mints a server certificate, signed by caKey/caCert, valid
+// for dnsNames and for ttl.
+func generateLeafCert(caKey *rsa.PrivateKey, caCert *x509.Certificate, dnsNames []string, ttl time.Duration) (certPem, keyPem []byte, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, selfSignedCertRSAKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     dnsNames,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return encodeCertPEM(der), encodeKeyPEM(key), nil
+}
+
+func randomSerial() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, limit)
+}
+
+func encodeCertPEM(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func encodeKeyPEM(key *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
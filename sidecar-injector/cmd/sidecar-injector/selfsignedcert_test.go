@@ -0,0 +1,114 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRotateReusesCAAcrossLeafRotations(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	c := newSelfSignedCertController(client, "istio-system", "istio-sidecar-injector-certs",
+		[]string{"istio-sidecar-injector.istio-system.svc"}, time.Hour, nil)
+
+	if err := c.loadOrGenerate(); err != nil {
+		t.Fatalf("loadOrGenerate: %v", err)
+	}
+	caCertPem := c.CACertPem()
+	firstLeaf, ok := c.cert.Load().(*tls.Certificate)
+	if !ok {
+		t.Fatal("no leaf certificate generated by bootstrap")
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := c.rotate(); err != nil {
+			t.Fatalf("rotate() #%d: %v", i, err)
+		}
+		if !bytes.Equal(c.CACertPem(), caCertPem) {
+			t.Fatalf("rotate() #%d regenerated the CA; the patched CABundle would have changed", i)
+		}
+	}
+
+	rotatedLeaf, ok := c.cert.Load().(*tls.Certificate)
+	if !ok {
+		t.Fatal("no leaf certificate after rotation")
+	}
+	if bytes.Equal(firstLeaf.Certificate[0], rotatedLeaf.Certificate[0]) {
+		t.Fatal("rotate() did not rotate the leaf certificate")
+	}
+}
+
+func TestRotateRegeneratesCAWhenItIsCloseToExpiring(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	c := newSelfSignedCertController(client, "istio-system", "istio-sidecar-injector-certs",
+		[]string{"istio-sidecar-injector.istio-system.svc"}, time.Hour, nil)
+
+	if err := c.loadOrGenerate(); err != nil {
+		t.Fatalf("loadOrGenerate: %v", err)
+	}
+	caCertPem := c.CACertPem()
+
+	// Simulate the CA itself being within one leaf certTTL of expiring.
+	c.mu.Lock()
+	c.caCert.NotAfter = time.Now().Add(c.certTTL / 2)
+	c.mu.Unlock()
+
+	if err := c.rotate(); err != nil {
+		t.Fatalf("rotate(): %v", err)
+	}
+	if bytes.Equal(c.CACertPem(), caCertPem) {
+		t.Fatal("rotate() did not regenerate a CA approaching expiry")
+	}
+}
+
+func TestNextRotationTracksLeafExpiry(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	c := newSelfSignedCertController(client, "istio-system", "istio-sidecar-injector-certs",
+		[]string{"istio-sidecar-injector.istio-system.svc"}, time.Hour, nil)
+
+	if err := c.loadOrGenerate(); err != nil {
+		t.Fatalf("loadOrGenerate: %v", err)
+	}
+
+	wait := c.nextRotation()
+	if wait <= 0 || wait >= c.certTTL {
+		t.Fatalf("nextRotation() = %v, want a positive duration less than the leaf TTL (%v)", wait, c.certTTL)
+	}
+}
+
+func TestBootstrapAdoptsCACreatedByAnotherReplica(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	winner := newSelfSignedCertController(client, "istio-system", "istio-sidecar-injector-certs",
+		[]string{"istio-sidecar-injector.istio-system.svc"}, time.Hour, nil)
+	if err := winner.bootstrapCA(); err != nil {
+		t.Fatalf("winner bootstrapCA: %v", err)
+	}
+	winnerCACertPem := winner.CACertPem()
+
+	loser := newSelfSignedCertController(client, "istio-system", "istio-sidecar-injector-certs",
+		[]string{"istio-sidecar-injector.istio-system.svc"}, time.Hour, nil)
+	if err := loser.bootstrapCA(); err != nil {
+		t.Fatalf("loser bootstrapCA should adopt the winner's CA rather than fail: %v", err)
+	}
+
+	if !bytes.Equal(loser.CACertPem(), winnerCACertPem) {
+		t.Fatal("loser did not adopt the winning replica's CA")
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2019 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hashicorp/go-multierror"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"istio.io/istio/pkg/util"
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+)
+
+// syncKey is the single workqueue item used to trigger a reconcile. Every
+// trigger - an informer event, a CA file change, or a periodic resync -
+// enqueues this same key, so a burst of events collapses into one sync.
+const syncKey = "sync"
+
+const (
+	minRetryInterval = 250 * time.Millisecond
+	maxRetryInterval = 5 * time.Minute
+	resyncPeriod     = time.Minute
+)
+
+var (
+	webhookKindLabel = monitoring.MustCreateLabel("kind")
+	fingerprintLabel = monitoring.MustCreateLabel("fingerprint")
+
+	patchAttemptsTotal = monitoring.NewSum(
+		"webhook_ca_patch_attempts_total",
+		"Number of attempts to patch a webhook configuration's CABundle.",
+		monitoring.WithLabels(webhookKindLabel),
+	)
+	patchFailuresTotal = monitoring.NewSum(
+		"webhook_ca_patch_failures_total",
+		"Number of failed attempts to patch a webhook configuration's CABundle.",
+		monitoring.WithLabels(webhookKindLabel),
+	)
+	caCertFingerprint = monitoring.NewGauge(
+		"webhook_ca_cert_fingerprint_info",
+		"Set to 1, labeled by fingerprint, for the SHA-256 fingerprint of each CA certificate read for patching; "+
+			"it is recorded before the patch is attempted, and earlier fingerprints are not reset.",
+		monitoring.WithLabels(fingerprintLabel),
+	)
+)
+
+func init() {
+	monitoring.MustRegister(patchAttemptsTotal, patchFailuresTotal, caCertFingerprint)
+}
+
+// webhookReconciler keeps the CABundle of a MutatingWebhookConfiguration and,
+// optionally, a ValidatingWebhookConfiguration, in sync with a single CA
+// certificate. Informer events, CA file changes and periodic resyncs all
+// enqueue the same workqueue key; a single worker pops it, re-reads the
+// current CA and patches both webhook configurations, retrying failures
+// with exponential backoff rather than the fixed-interval retry (and
+// fsnotify v0 watcher, which misses Kubernetes secret symlink swaps on some
+// kernels) used previously.
+type webhookReconciler struct {
+	client kubernetes.Interface
+
+	mutatingWebhookConfigName   string
+	validatingWebhookConfigName string
+	webhookName                 string
+
+	// caCertFile is watched for changes via fsnotify when non-empty. It is
+	// empty when the CA is instead owned by a selfSignedCertController,
+	// which calls Sync directly on rotation.
+	caCertFile string
+	caCertPem  func() ([]byte, error)
+
+	queue workqueue.RateLimitingInterface
+}
+
+// newWebhookReconciler builds a reconciler for mutatingWebhookConfigName and,
+// if non-empty, validatingWebhookConfigName. caCertPem is called to fetch
+// the current CA bundle each time a sync runs. caCertFile, if non-empty, is
+// watched for on-disk changes (e.g. a projected Secret being rotated).
+func newWebhookReconciler(client kubernetes.Interface, mutatingWebhookConfigName, validatingWebhookConfigName,
+	webhookName, caCertFile string, caCertPem func() ([]byte, error)) *webhookReconciler {
+	return &webhookReconciler{
+		client:                      client,
+		mutatingWebhookConfigName:   mutatingWebhookConfigName,
+		validatingWebhookConfigName: validatingWebhookConfigName,
+		webhookName:                 webhookName,
+		caCertFile:                  caCertFile,
+		caCertPem:                   caCertPem,
+		queue: workqueue.NewRateLimitingQueue(
+			workqueue.NewItemExponentialFailureRateLimiter(minRetryInterval, maxRetryInterval)),
+	}
+}
+
+// Run starts watching for changes and runs the worker loop until stopCh is
+// closed. It returns once the informer caches have synced and the initial
+// reconcile has been enqueued; the worker itself runs in the background.
+func (r *webhookReconciler) Run(stopCh <-chan struct{}) error {
+	factory := informers.NewSharedInformerFactory(r.client, resyncPeriod)
+	admission := factory.Admissionregistration().V1beta1()
+
+	admission.MutatingWebhookConfigurations().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { r.queue.Add(syncKey) },
+		UpdateFunc: func(interface{}, interface{}) { r.queue.Add(syncKey) },
+	})
+	if r.validatingWebhookConfigName != "" {
+		admission.ValidatingWebhookConfigurations().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(interface{}) { r.queue.Add(syncKey) },
+			UpdateFunc: func(interface{}, interface{}) { r.queue.Add(syncKey) },
+		})
+	}
+
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+
+	if r.caCertFile != "" {
+		if err := r.watchCACertFile(stopCh); err != nil {
+			return err
+		}
+	}
+
+	go wait.Until(func() { r.queue.Add(syncKey) }, resyncPeriod, stopCh)
+
+	r.queue.Add(syncKey)
+	go r.runWorker(stopCh)
+
+	return nil
+}
+
+// Sync enqueues a reconcile, e.g. after a selfSignedCertController rotation.
+func (r *webhookReconciler) Sync() {
+	r.queue.Add(syncKey)
+}
+
+// watchCACertFile watches caCertFile's directory using fsnotify v1, which
+// (unlike howeyc/fsnotify) correctly picks up the atomic "..data" symlink
+// rename Kubernetes uses to publish a projected Secret update.
+func (r *webhookReconciler) watchCACertFile(stopCh <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	watchDir, _ := filepath.Split(r.caCertFile)
+	if err := watcher.Add(watchDir); err != nil {
+		return fmt.Errorf("could not watch %v: %v", r.caCertFile, err)
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Name == r.caCertFile || filepath.Base(event.Name) == "..data" {
+					log.Infof("Detected a change in %s, reconciling webhook CABundle", r.caCertFile)
+					r.queue.Add(syncKey)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("CA cert file watch error: %v", err)
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (r *webhookReconciler) runWorker(stopCh <-chan struct{}) {
+	go func() {
+		<-stopCh
+		r.queue.ShutDown()
+	}()
+
+	for r.processNextItem() {
+	}
+}
+
+func (r *webhookReconciler) processNextItem() bool {
+	key, quit := r.queue.Get()
+	if quit {
+		return false
+	}
+	defer r.queue.Done(key)
+
+	if err := r.sync(); err != nil {
+		log.Errorf("webhook CA reconcile failed, retrying: %v", err)
+		r.queue.AddRateLimited(key)
+		return true
+	}
+	r.queue.Forget(key)
+	return true
+}
+
+// sync reads the current CA bundle and patches the mutating (and, if
+// configured, validating) webhook configuration to match it.
+func (r *webhookReconciler) sync() error {
+	caCertPem, err := r.caCertPem()
+	if err != nil {
+		return fmt.Errorf("failed to read CA certificate: %v", err)
+	}
+
+	fingerprint := fmt.Sprintf("%x", sha256.Sum256(caCertPem))
+	caCertFingerprint.With(fingerprintLabel.Value(fingerprint)).Record(1)
+
+	var errs *multierror.Error
+	patchAttemptsTotal.With(webhookKindLabel.Value(string(mutatingWebhookKind))).Increment()
+	if err := util.PatchMutatingWebhookConfig(r.client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations(),
+		r.mutatingWebhookConfigName, r.webhookName, caCertPem); err != nil {
+		patchFailuresTotal.With(webhookKindLabel.Value(string(mutatingWebhookKind))).Increment()
+		errs = multierror.Append(errs, fmt.Errorf("failed to patch %s: %v", mutatingWebhookKind, err))
+	}
+
+	if r.validatingWebhookConfigName != "" {
+		patchAttemptsTotal.With(webhookKindLabel.Value(string(validatingWebhookKind))).Increment()
+		if err := util.PatchValidatingWebhookConfig(r.client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations(),
+			r.validatingWebhookConfigName, r.webhookName, caCertPem); err != nil {
+			patchFailuresTotal.With(webhookKindLabel.Value(string(validatingWebhookKind))).Increment()
+			errs = multierror.Append(errs, fmt.Errorf("failed to patch %s: %v", validatingWebhookKind, err))
+		}
+	}
+
+	return errs.ErrorOrNil()
+}
+
+// webhookKind identifies which kind of webhook configuration a patch targets.
+type webhookKind string
+
+const (
+	mutatingWebhookKind   webhookKind = "MutatingWebhookConfiguration"
+	validatingWebhookKind webhookKind = "ValidatingWebhookConfiguration"
+)